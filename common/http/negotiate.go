@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package http
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NegotiateTabular answers a query returning tabular data (a set of
+// dimension columns plus a "bps" value per row) in whichever format the
+// client asked for through its Accept header: CSV, TSV, or JSON as a
+// fallback. This lets console endpoints such as sankeyQuery expose the same
+// data to spreadsheets and scripts without a dedicated export API.
+//
+// CSV and TSV are written and flushed row by row instead of being encoded
+// as one buffered payload; the rows themselves are passed in as a whole
+// slice. The jsonPayload
+// callback is only invoked when JSON is negotiated, since building it (for
+// example computing a sankey diagram's nodes and links) can be more
+// expensive than just forwarding the rows.
+func NegotiateTabular(c *gin.Context, headers []string, rows [][]string, bps []float64, jsonPayload func() gin.H) {
+	switch c.NegotiateFormat(gin.MIMEJSON, "text/csv", "text/tab-separated-values") {
+	case "text/csv":
+		writeTabular(c, ',', "text/csv", headers, rows, bps)
+	case "text/tab-separated-values":
+		writeTabular(c, '\t', "text/tab-separated-values", headers, rows, bps)
+	default:
+		c.JSON(http.StatusOK, jsonPayload())
+	}
+}
+
+func writeTabular(c *gin.Context, comma rune, contentType string, headers []string, rows [][]string, bps []float64) {
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", contentType+"; charset=utf-8")
+
+	w := csv.NewWriter(c.Writer)
+	w.Comma = comma
+
+	record := make([]string, len(headers)+1)
+	copy(record, headers)
+	record[len(headers)] = "bps"
+	if err := w.Write(record); err != nil {
+		return
+	}
+	for i, row := range rows {
+		copy(record, row)
+		record[len(headers)] = strconv.FormatFloat(bps[i], 'f', -1, 64)
+		if err := w.Write(record); err != nil {
+			return
+		}
+		// Flush after each row so clients piping the output start
+		// receiving data without waiting for the whole result set.
+		w.Flush()
+	}
+}
@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package http
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"akvorado/common/helpers"
+)
+
+func testNegotiate(t *testing.T, accept string) (int, string, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	if accept != "" {
+		c.Request.Header.Set("Accept", accept)
+	}
+
+	NegotiateTabular(c, []string{"SrcAS", "ExporterName"},
+		[][]string{{"AS100", "provider1"}, {"AS200", "provider2"}},
+		[]float64{1000, 2500.5},
+		func() gin.H {
+			return gin.H{"rows": [][]string{{"AS100", "provider1"}, {"AS200", "provider2"}}}
+		})
+
+	return w.Code, w.Header().Get("Content-Type"), w.Body.String()
+}
+
+func TestNegotiateTabularCSV(t *testing.T) {
+	code, contentType, body := testNegotiate(t, "text/csv")
+	if code != 200 {
+		t.Errorf("NegotiateTabular() status = %d, expected 200", code)
+	}
+	if contentType != "text/csv; charset=utf-8" {
+		t.Errorf("NegotiateTabular() Content-Type = %q, expected %q", contentType, "text/csv; charset=utf-8")
+	}
+	expected := "SrcAS,ExporterName,bps\nAS100,provider1,1000\nAS200,provider2,2500.5\n"
+	if body != expected {
+		t.Errorf("NegotiateTabular() body (-got, +want):\n%s",
+			helpers.Diff(strings.Split(body, "\n"), strings.Split(expected, "\n")))
+	}
+}
+
+func TestNegotiateTabularTSV(t *testing.T) {
+	code, contentType, body := testNegotiate(t, "text/tab-separated-values")
+	if code != 200 {
+		t.Errorf("NegotiateTabular() status = %d, expected 200", code)
+	}
+	if contentType != "text/tab-separated-values; charset=utf-8" {
+		t.Errorf("NegotiateTabular() Content-Type = %q, expected %q", contentType, "text/tab-separated-values; charset=utf-8")
+	}
+	expected := "SrcAS\tExporterName\tbps\nAS100\tprovider1\t1000\nAS200\tprovider2\t2500.5\n"
+	if body != expected {
+		t.Errorf("NegotiateTabular() body (-got, +want):\n%s",
+			helpers.Diff(strings.Split(body, "\n"), strings.Split(expected, "\n")))
+	}
+}
+
+func TestNegotiateTabularJSON(t *testing.T) {
+	code, contentType, body := testNegotiate(t, "application/json")
+	if code != 200 {
+		t.Errorf("NegotiateTabular() status = %d, expected 200", code)
+	}
+	if !strings.HasPrefix(contentType, "application/json") {
+		t.Errorf("NegotiateTabular() Content-Type = %q, expected application/json prefix", contentType)
+	}
+	expected := `{"rows":[["AS100","provider1"],["AS200","provider2"]]}`
+	if strings.TrimSpace(body) != expected {
+		t.Errorf("NegotiateTabular() body = %q, expected %q", body, expected)
+	}
+}
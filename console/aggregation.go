@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import "fmt"
+
+// aggregationMode selects how rows falling outside of the kept set are
+// lumped into "Other" buckets.
+type aggregationMode string
+
+const (
+	// aggregationModeTopN keeps the N top combinations by SUM(Bytes).
+	aggregationModeTopN aggregationMode = "topN"
+	// aggregationModeThreshold keeps combinations contributing at least
+	// MinPercent of the total bps.
+	aggregationModeThreshold aggregationMode = "threshold"
+	// aggregationModeCumulative keeps just enough combinations, ranked
+	// by decreasing bps, to cover CoverPercent of the total bps.
+	aggregationModeCumulative aggregationMode = "cumulative"
+)
+
+// aggregation configures the "Other" bucketing threshold for a sankey
+// query. Exactly one of N, MinPercent or CoverPercent is meaningful,
+// matching Mode.
+type aggregation struct {
+	Mode         aggregationMode `json:"mode" binding:"required,oneof=topN threshold cumulative"`
+	N            int             `json:"n,omitempty"`
+	MinPercent   float64         `json:"minPercent,omitempty"`
+	CoverPercent float64         `json:"coverPercent,omitempty"`
+}
+
+// validate checks that the aggregation carries the field matching its mode
+// and nothing else, so a request cannot mix, say, N and MinPercent.
+func (agg aggregation) validate() error {
+	switch agg.Mode {
+	case aggregationModeTopN:
+		if agg.N <= 0 {
+			return fmt.Errorf("aggregation mode %q requires a positive n", agg.Mode)
+		}
+		if agg.MinPercent != 0 || agg.CoverPercent != 0 {
+			return fmt.Errorf("aggregation mode %q does not accept minPercent or coverPercent", agg.Mode)
+		}
+	case aggregationModeThreshold:
+		if agg.MinPercent <= 0 || agg.MinPercent >= 100 {
+			return fmt.Errorf("aggregation mode %q requires a minPercent between 0 and 100", agg.Mode)
+		}
+		if agg.N != 0 || agg.CoverPercent != 0 {
+			return fmt.Errorf("aggregation mode %q does not accept n or coverPercent", agg.Mode)
+		}
+	case aggregationModeCumulative:
+		if agg.CoverPercent <= 0 || agg.CoverPercent > 100 {
+			return fmt.Errorf("aggregation mode %q requires a coverPercent between 0 and 100", agg.Mode)
+		}
+		if agg.N != 0 || agg.MinPercent != 0 {
+			return fmt.Errorf("aggregation mode %q does not accept n or minPercent", agg.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown aggregation mode %q", agg.Mode)
+	}
+	return nil
+}
+
+// rowsSubquery returns the SQL for the "rows" CTE keeping the combinations
+// of dimension values that should not be lumped into "Other", given the
+// select list and where clause already built by the caller.
+func (agg aggregation) rowsSubquery(selectColumns, where string, dimensionCount int) string {
+	switch agg.Mode {
+	case aggregationModeThreshold:
+		return fmt.Sprintf(
+			"rows AS (SELECT %s FROM {table} WHERE %s GROUP BY %s HAVING SUM(Bytes) >= (SELECT SUM(Bytes) FROM {table} WHERE %s) * %g / 100)",
+			selectColumns, where, selectColumns, where, agg.MinPercent)
+	case aggregationModeCumulative:
+		// cumulative is a running total that includes the current row, so
+		// comparing it directly against the threshold would drop the very
+		// row that crosses it (e.g. a single dominant combination above
+		// CoverPercent would empty the CTE entirely). Subtract the
+		// current row's own contribution before comparing, so the row
+		// that crosses the threshold is still the last one kept.
+		return fmt.Sprintf(
+			"rows AS (SELECT %s FROM (SELECT %s, SUM(SUM(Bytes)) OVER (ORDER BY SUM(Bytes) DESC ROWS UNBOUNDED PRECEDING) AS cumulative, SUM(Bytes) AS current, SUM(SUM(Bytes)) OVER () AS overall FROM {table} WHERE %s GROUP BY %s) WHERE cumulative - current <= overall * %g / 100)",
+			selectColumns, selectColumns, where, selectColumns, agg.CoverPercent)
+	default: // aggregationModeTopN
+		return fmt.Sprintf(
+			"rows AS (SELECT %s FROM {table} WHERE %s GROUP BY %s ORDER BY SUM(Bytes) DESC LIMIT %d)",
+			selectColumns, where, selectColumns, agg.N)
+	}
+}
+
+// coverage returns the fraction (between 0 and 1) of the total bps
+// represented by rows where no dimension was lumped into "Other".
+func coverage(results []sankeyQueryResult) float64 {
+	var total, kept float64
+	for _, result := range results {
+		total += result.Bps
+		isOther := false
+		for _, value := range result.Dimensions {
+			if value == "Other" {
+				isOther = true
+				break
+			}
+		}
+		if !isOther {
+			kept += result.Bps
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return kept / total
+}
@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"akvorado/common/helpers"
+)
+
+func TestSankeyQueryAggregationSQL(t *testing.T) {
+	cases := []struct {
+		Description string
+		Input       sankeyQuery
+		Expected    string
+	}{
+		{
+			Description: "threshold aggregation",
+			Input: sankeyQuery{
+				Start:      time.Date(2022, 04, 10, 15, 45, 10, 0, time.UTC),
+				End:        time.Date(2022, 04, 11, 15, 45, 10, 0, time.UTC),
+				Dimensions: []queryColumn{queryColumnExporterName},
+				Aggregation: &aggregation{
+					Mode:       aggregationModeThreshold,
+					MinPercent: 0.5,
+				},
+			},
+			Expected: `
+WITH
+ (SELECT MAX(TimeReceived) - MIN(TimeReceived) FROM {table} WHERE {timefilter}) AS range,
+ rows AS (SELECT ExporterName FROM {table} WHERE {timefilter} GROUP BY ExporterName HAVING SUM(Bytes) >= (SELECT SUM(Bytes) FROM {table} WHERE {timefilter}) * 0.5 / 100)
+SELECT
+ SUM(Bytes*SamplingRate*8/range) AS bps,
+ [if(ExporterName IN (SELECT ExporterName FROM rows), ExporterName, 'Other')] AS dimensions
+FROM {table}
+WHERE {timefilter}
+GROUP BY dimensions
+ORDER BY bps DESC`,
+		}, {
+			Description: "cumulative aggregation",
+			Input: sankeyQuery{
+				Start:      time.Date(2022, 04, 10, 15, 45, 10, 0, time.UTC),
+				End:        time.Date(2022, 04, 11, 15, 45, 10, 0, time.UTC),
+				Dimensions: []queryColumn{queryColumnExporterName},
+				Aggregation: &aggregation{
+					Mode:         aggregationModeCumulative,
+					CoverPercent: 95,
+				},
+			},
+			Expected: `
+WITH
+ (SELECT MAX(TimeReceived) - MIN(TimeReceived) FROM {table} WHERE {timefilter}) AS range,
+ rows AS (SELECT ExporterName FROM (SELECT ExporterName, SUM(SUM(Bytes)) OVER (ORDER BY SUM(Bytes) DESC ROWS UNBOUNDED PRECEDING) AS cumulative, SUM(Bytes) AS current, SUM(SUM(Bytes)) OVER () AS overall FROM {table} WHERE {timefilter} GROUP BY ExporterName) WHERE cumulative - current <= overall * 95 / 100)
+SELECT
+ SUM(Bytes*SamplingRate*8/range) AS bps,
+ [if(ExporterName IN (SELECT ExporterName FROM rows), ExporterName, 'Other')] AS dimensions
+FROM {table}
+WHERE {timefilter}
+GROUP BY dimensions
+ORDER BY bps DESC`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Description, func(t *testing.T) {
+			got, err := tc.Input.toSQL()
+			if err != nil {
+				t.Fatalf("toSQL() error:\n%+v", err)
+			}
+			if diff := helpers.Diff(strings.Split(got, "\n"), strings.Split(tc.Expected, "\n")); diff != "" {
+				t.Errorf("toSQL (-got, +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestAggregationCumulativeDominantRowKept is a regression test for a
+// single dominant combination whose own share already exceeds CoverPercent
+// (e.g. 96% of traffic with CoverPercent: 95). Comparing an inclusive
+// running total directly against the threshold would exclude that row --
+// and since it's the first ranked row, the whole "rows" CTE would end up
+// empty. It mirrors the "cumulative - current <= overall * coverPercent /
+// 100" comparison generated by rowsSubquery, since the actual predicate can
+// only be exercised against a real ClickHouse instance.
+func TestAggregationCumulativeDominantRowKept(t *testing.T) {
+	byteCounts := []float64{96, 3, 1} // one dominant row, ranked first
+	var overall float64
+	for _, bytes := range byteCounts {
+		overall += bytes
+	}
+
+	const coverPercent = 95.0
+	var cumulative float64
+	kept := 0
+	for _, current := range byteCounts {
+		cumulative += current
+		if cumulative-current <= overall*coverPercent/100 {
+			kept++
+		}
+	}
+	if kept != 1 {
+		t.Errorf("cumulative aggregation kept %d row(s), expected 1 (the dominant row alone covers 96%% >= 95%%)", kept)
+	}
+}
+
+func TestSankeyQueryAggregationMutuallyExclusive(t *testing.T) {
+	query := sankeyQuery{
+		Start:      time.Date(2022, 04, 10, 15, 45, 10, 0, time.UTC),
+		End:        time.Date(2022, 04, 11, 15, 45, 10, 0, time.UTC),
+		Dimensions: []queryColumn{queryColumnExporterName},
+		Limit:      5,
+		Aggregation: &aggregation{
+			Mode: aggregationModeThreshold,
+			MinPercent: 1,
+		},
+	}
+	if _, err := query.toSQL(); err == nil {
+		t.Error("toSQL() expected an error when limit and aggregation are both set, got none")
+	}
+}
+
+// TestSankeyQueryNegativeLimit checks that a bare negative Limit is
+// rejected by effectiveAggregation instead of reaching toSQL and
+// generating a "LIMIT -1" ClickHouse will reject at query time.
+func TestSankeyQueryNegativeLimit(t *testing.T) {
+	query := sankeyQuery{
+		Start:      time.Date(2022, 04, 10, 15, 45, 10, 0, time.UTC),
+		End:        time.Date(2022, 04, 11, 15, 45, 10, 0, time.UTC),
+		Dimensions: []queryColumn{queryColumnExporterName},
+		Limit:      -1,
+	}
+	if _, err := query.toSQL(); err == nil {
+		t.Error("toSQL() expected an error for a negative limit, got none")
+	}
+}
+
+func TestAggregationValidate(t *testing.T) {
+	cases := []struct {
+		Description string
+		Input       aggregation
+		WantError   bool
+	}{
+		{"valid topN", aggregation{Mode: aggregationModeTopN, N: 10}, false},
+		{"topN without n", aggregation{Mode: aggregationModeTopN}, true},
+		{"topN with minPercent", aggregation{Mode: aggregationModeTopN, N: 10, MinPercent: 1}, true},
+		{"valid threshold", aggregation{Mode: aggregationModeThreshold, MinPercent: 0.5}, false},
+		{"threshold out of range", aggregation{Mode: aggregationModeThreshold, MinPercent: 150}, true},
+		{"valid cumulative", aggregation{Mode: aggregationModeCumulative, CoverPercent: 95}, false},
+		{"cumulative out of range", aggregation{Mode: aggregationModeCumulative, CoverPercent: 0}, true},
+		{"unknown mode", aggregation{Mode: "bogus"}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Description, func(t *testing.T) {
+			err := tc.Input.validate()
+			if (err != nil) != tc.WantError {
+				t.Errorf("validate() = %v, wantError = %v", err, tc.WantError)
+			}
+		})
+	}
+}
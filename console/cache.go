@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// queryCache memoizes ClickHouse query results keyed by a canonicalized
+// representation of the query parameters. It is backed either by an
+// in-memory LRU (memoryCache) or by Redis (redisCache), selected through
+// Configuration.CacheBackend.
+type queryCache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+const (
+	// cacheTTLPast is used for queries whose time range lies entirely in
+	// the past: the underlying data cannot change anymore.
+	cacheTTLPast = 24 * time.Hour
+	// cacheTTLNow is used for queries reaching close to the current
+	// time, where ClickHouse may still be ingesting matching flows.
+	cacheTTLNow = 10 * time.Second
+	// cacheNowSlack is how close to "now" a query's End needs to be
+	// before it is considered to be querying live data.
+	cacheNowSlack = time.Minute
+)
+
+// cacheTTL returns how long a query result may be cached for, given the
+// query's End time and the current time.
+func cacheTTL(end, now time.Time) time.Duration {
+	if end.Before(now.Add(-cacheNowSlack)) {
+		return cacheTTLPast
+	}
+	return cacheTTLNow
+}
+
+// cacheKey builds a canonical, content-addressed cache key for a query. The
+// query is serialized to JSON to get a representation stable across process
+// restarts, then hashed to keep keys short.
+func cacheKey(namespace string, query any) (string, error) {
+	encoded, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return namespace + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+// cachedQuery runs fetch, memoizing its result in c.cache under key for ttl.
+// Concurrent calls sharing the same key are collapsed into a single fetch
+// through a singleflight.Group so that a burst of identical requests (for
+// example, several browsers loading the same dashboard) only hits
+// ClickHouse once.
+func (c *Component) cachedQuery(ctx context.Context, queryName, key string, ttl time.Duration, fetch func() ([]byte, error)) ([]byte, error) {
+	if cached, ok, err := c.cache.Get(ctx, key); err != nil {
+		c.r.Err(err).Str("query", queryName).Msg("cache backend error, bypassing cache")
+	} else if ok {
+		c.metrics.cacheHits.WithLabelValues(queryName).Inc()
+		return cached, nil
+	}
+	c.metrics.cacheMisses.WithLabelValues(queryName).Inc()
+
+	value, err, _ := c.cacheGroup.Do(key, func() (any, error) {
+		return fetch()
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := value.([]byte)
+	if err := c.cache.Set(ctx, key, result, ttl); err != nil {
+		c.r.Err(err).Str("query", queryName).Msg("unable to populate cache")
+	}
+	return result, nil
+}
@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// memoryCacheEntry is a cached value together with its expiration time.
+type memoryCacheEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// memoryCache is a queryCache implementation backed by an in-process LRU.
+// It is the default backend: simple, but not shared across console
+// instances.
+type memoryCache struct {
+	mu    sync.Mutex
+	cache *lru.Cache[string, memoryCacheEntry]
+}
+
+// newMemoryCache creates an in-memory query cache holding up to size
+// entries, evicting the least recently used one once full.
+func newMemoryCache(size int, onEvicted func()) (*memoryCache, error) {
+	cache, err := lru.NewWithEvict(size, func(_ string, _ memoryCacheEntry) {
+		onEvicted()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &memoryCache{cache: cache}, nil
+}
+
+func (m *memoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.cache.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(entry.expiresAt) {
+		// Evict right away instead of leaving a dead entry occupying a
+		// slot until it is naturally LRU-evicted or overwritten.
+		m.cache.Remove(key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (m *memoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cache.Add(key, memoryCacheEntry{value: value, expiresAt: time.Now().Add(ttl)})
+	return nil
+}
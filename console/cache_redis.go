@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisCachePrefix namespaces cache keys so the console component does not
+// collide with other users of the same Redis database.
+const redisCachePrefix = "akvorado:console:cache:"
+
+// redisCache is a queryCache implementation backed by Redis, letting several
+// console instances behind a load-balancer share cached query results.
+type redisCache struct {
+	client redis.UniversalClient
+}
+
+// newRedisCache creates a query cache backed by the provided Redis client.
+func newRedisCache(client redis.UniversalClient) *redisCache {
+	return &redisCache{client: client}
+}
+
+func (r *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := r.client.Get(ctx, redisCachePrefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (r *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, redisCachePrefix+key, value, ttl).Err()
+}
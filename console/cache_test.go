@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Date(2022, 04, 11, 15, 45, 10, 0, time.UTC)
+	cases := []struct {
+		Description string
+		End         time.Time
+		Expected    time.Duration
+	}{
+		{
+			Description: "end far in the past",
+			End:         now.Add(-24 * time.Hour),
+			Expected:    cacheTTLPast,
+		}, {
+			Description: "end close to now",
+			End:         now.Add(-5 * time.Second),
+			Expected:    cacheTTLNow,
+		}, {
+			Description: "end in the future",
+			End:         now.Add(time.Minute),
+			Expected:    cacheTTLNow,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Description, func(t *testing.T) {
+			got := cacheTTL(tc.End, now)
+			if got != tc.Expected {
+				t.Errorf("cacheTTL() == %s, expected %s", got, tc.Expected)
+			}
+		})
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	evictions := 0
+	cache, err := newMemoryCache(1, func() { evictions++ })
+	if err != nil {
+		t.Fatalf("newMemoryCache() error:\n%+v", err)
+	}
+	ctx := context.Background()
+
+	if err := cache.Set(ctx, "a", []byte("hello"), time.Minute); err != nil {
+		t.Fatalf("Set() error:\n%+v", err)
+	}
+	if got, ok, err := cache.Get(ctx, "a"); err != nil || !ok || string(got) != "hello" {
+		t.Errorf("Get(%q) == (%q, %v, %v), expected (%q, true, nil)", "a", got, ok, err, "hello")
+	}
+
+	// Adding a second entry should evict the first one (LRU, size 1).
+	if err := cache.Set(ctx, "b", []byte("world"), time.Minute); err != nil {
+		t.Fatalf("Set() error:\n%+v", err)
+	}
+	if _, ok, _ := cache.Get(ctx, "a"); ok {
+		t.Errorf("Get(%q) found an entry that should have been evicted", "a")
+	}
+	if evictions != 1 {
+		t.Errorf("evictions == %d, expected 1", evictions)
+	}
+
+	// Expired entries should be reported as a miss, and evicted right
+	// away instead of lingering and occupying a slot.
+	if err := cache.Set(ctx, "c", []byte("!"), -time.Second); err != nil {
+		t.Fatalf("Set() error:\n%+v", err)
+	}
+	if _, ok, _ := cache.Get(ctx, "c"); ok {
+		t.Errorf("Get(%q) found an entry that should have expired", "c")
+	}
+	if cache.cache.Contains("c") {
+		t.Error("Get() did not evict the expired entry")
+	}
+	if evictions != 3 {
+		t.Errorf("evictions == %d, expected 3 (b evicted by c, then c evicted on expiry)", evictions)
+	}
+}
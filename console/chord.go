@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"akvorado/common/helpers"
+)
+
+// chordQuery describes a chord diagram query: unlike a sankey query, it
+// takes exactly two dimensions and treats them symmetrically, since
+// relationships such as AS↔AS or router↔router traffic matrices have no
+// inherent direction.
+type chordQuery struct {
+	Start      time.Time     `json:"start" binding:"required"`
+	End        time.Time     `json:"end" binding:"required,gtfield=Start"`
+	Dimensions []queryColumn `json:"dimensions" binding:"required,len=2"`
+	Limit      int           `json:"limit" binding:"required,min=1,max=50"`
+	Filter     queryFilter   `json:"filter"`
+}
+
+// toSQL converts a chord query into the ClickHouse SQL query fetching the
+// bps contributed by each unordered pair of dimension values, with values
+// outside of the top `Limit` combinations lumped into "Other". It reuses the
+// "WITH rows AS (...)" pattern from sankeyQuery.toSQL, but the pair is
+// canonicalized as (least, greatest) before ranking and grouping, so that,
+// say, AS100→AS200 and AS200→AS100 contribute to the same top-N decision
+// instead of being ranked independently and possibly dropped even though
+// their combined, truly symmetric traffic would make the cut.
+func (query chordQuery) toSQL() (string, error) {
+	if len(query.Dimensions) != 2 {
+		return "", fmt.Errorf("chord query needs exactly 2 dimensions, got %d", len(query.Dimensions))
+	}
+	col1 := query.Dimensions[0].toSQLSelect()
+	col2 := query.Dimensions[1].toSQLSelect()
+
+	where := "{timefilter}"
+	if len(query.Filter) > 0 {
+		where = fmt.Sprintf("%s AND (%s)", where, strings.Join(query.Filter, " AND "))
+	}
+
+	pair1 := fmt.Sprintf("least(%s, %s)", col1, col2)
+	pair2 := fmt.Sprintf("greatest(%s, %s)", col1, col2)
+	kept := fmt.Sprintf("(%s, %s) IN (SELECT pair1, pair2 FROM rows)", pair1, pair2)
+
+	sqlQuery := fmt.Sprintf(`
+WITH
+ (SELECT MAX(TimeReceived) - MIN(TimeReceived) FROM {table} WHERE %s) AS range,
+ rows AS (SELECT %s AS pair1, %s AS pair2 FROM {table} WHERE %s GROUP BY pair1, pair2 ORDER BY SUM(Bytes) DESC LIMIT %d)
+SELECT
+ SUM(Bytes*SamplingRate*8/range) AS bps,
+ if(%s, %s, 'Other') AS label1,
+ if(%s, %s, 'Other') AS label2
+FROM {table}
+WHERE %s
+GROUP BY label1, label2
+ORDER BY bps DESC`,
+		where,
+		pair1, pair2, where, query.Limit,
+		kept, query.Dimensions[0].toSQLLabel(),
+		kept, query.Dimensions[1].toSQLLabel(),
+		where)
+	return sqlQuery, nil
+}
+
+// chordQueryResult is a single row returned by ClickHouse for a chord query.
+type chordQueryResult struct {
+	Bps    float64 `ch:"bps"`
+	Label1 string  `ch:"label1"`
+	Label2 string  `ch:"label2"`
+}
+
+// toChordData turns the raw ClickHouse rows into the labels/matrix payload
+// expected by a d3-chord diagram on the frontend: a square bps matrix plus
+// the same matrix normalized to a percentage of the total traffic.
+func toChordData(results []chordQueryResult) gin.H {
+	labels := []string{}
+	index := map[string]int{}
+	addLabel := func(label string) {
+		if _, ok := index[label]; !ok {
+			index[label] = len(labels)
+			labels = append(labels, label)
+		}
+	}
+	for _, result := range results {
+		addLabel(result.Label1)
+		addLabel(result.Label2)
+	}
+
+	matrix := make([][]float64, len(labels))
+	for i := range matrix {
+		matrix[i] = make([]float64, len(labels))
+	}
+	var total float64
+	for _, result := range results {
+		i, j := index[result.Label1], index[result.Label2]
+		matrix[i][j] += result.Bps
+		if i != j {
+			matrix[j][i] += result.Bps
+		}
+		total += result.Bps
+	}
+
+	matrixPercent := make([][]float64, len(labels))
+	for i, row := range matrix {
+		matrixPercent[i] = make([]float64, len(labels))
+		for j, bps := range row {
+			if total > 0 {
+				matrixPercent[i][j] = bps / total * 100
+			}
+		}
+	}
+
+	return gin.H{
+		"labels":        labels,
+		"matrix":        matrix,
+		"matrixPercent": matrixPercent,
+	}
+}
+
+// chordHandlerFunc handles a chord query: it parses the query, runs it
+// against ClickHouse (through the query cache) and returns the resulting
+// traffic matrix.
+func (c *Component) chordHandlerFunc(ctx *gin.Context) {
+	var input chordQuery
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": helpers.Capitalize(err.Error())})
+		return
+	}
+
+	sqlQuery, err := input.toSQL()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": helpers.Capitalize(err.Error())})
+		return
+	}
+	sqlQuery = c.finalizeQuery(sqlQuery, input.Start, input.End)
+
+	results, err := c.runChordQuery(ctx.Request.Context(), input, sqlQuery)
+	if err != nil {
+		c.r.Err(err).Msg("unable to query chord data")
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": "unable to query ClickHouse"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, toChordData(results))
+}
+
+// cacheKeyParts returns the canonicalized parameters used to key the query
+// cache: the raw filter clauses are sorted so that semantically identical
+// filters expressed in a different order hit the same cache entry.
+func (query chordQuery) cacheKeyParts() any {
+	filter := append([]string{}, query.Filter...)
+	sort.Strings(filter)
+	return struct {
+		Start      time.Time
+		End        time.Time
+		Dimensions []queryColumn
+		Limit      int
+		Filter     []string
+	}{query.Start, query.End, query.Dimensions, query.Limit, filter}
+}
+
+// runChordQuery executes sqlQuery against ClickHouse, going through the
+// query cache like runSankeyQuery does.
+func (c *Component) runChordQuery(ctx context.Context, input chordQuery, sqlQuery string) ([]chordQueryResult, error) {
+	key, err := cacheKey("chord", input.cacheKeyParts())
+	if err != nil {
+		return nil, err
+	}
+	ttl := cacheTTL(input.End, time.Now())
+
+	encoded, err := c.cachedQuery(ctx, "chord", key, ttl, func() ([]byte, error) {
+		var results []chordQueryResult
+		if err := c.d.ClickHouseDB.Conn.Select(ctx, &results, sqlQuery); err != nil {
+			return nil, err
+		}
+		return json.Marshal(results)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []chordQueryResult
+	if err := json.Unmarshal(encoded, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
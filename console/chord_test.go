@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"akvorado/common/helpers"
+)
+
+func TestChordQuerySQL(t *testing.T) {
+	cases := []struct {
+		Description string
+		Input       chordQuery
+		Expected    string
+	}{
+		{
+			Description: "two AS dimensions, no filters",
+			Input: chordQuery{
+				Start:      time.Date(2022, 04, 10, 15, 45, 10, 0, time.UTC),
+				End:        time.Date(2022, 04, 11, 15, 45, 10, 0, time.UTC),
+				Dimensions: []queryColumn{queryColumnSrcAS, queryColumnDstAS},
+				Limit:      5,
+				Filter:     queryFilter{},
+			},
+			Expected: `
+WITH
+ (SELECT MAX(TimeReceived) - MIN(TimeReceived) FROM {table} WHERE {timefilter}) AS range,
+ rows AS (SELECT least(SrcAS, DstAS) AS pair1, greatest(SrcAS, DstAS) AS pair2 FROM {table} WHERE {timefilter} GROUP BY pair1, pair2 ORDER BY SUM(Bytes) DESC LIMIT 5)
+SELECT
+ SUM(Bytes*SamplingRate*8/range) AS bps,
+ if((least(SrcAS, DstAS), greatest(SrcAS, DstAS)) IN (SELECT pair1, pair2 FROM rows), concat(toString(SrcAS), ': ', dictGetOrDefault('asns', 'name', SrcAS, '???')), 'Other') AS label1,
+ if((least(SrcAS, DstAS), greatest(SrcAS, DstAS)) IN (SELECT pair1, pair2 FROM rows), concat(toString(DstAS), ': ', dictGetOrDefault('asns', 'name', DstAS, '???')), 'Other') AS label2
+FROM {table}
+WHERE {timefilter}
+GROUP BY label1, label2
+ORDER BY bps DESC`,
+		}, {
+			Description: "non-AS dimensions, no filters",
+			Input: chordQuery{
+				Start:      time.Date(2022, 04, 10, 15, 45, 10, 0, time.UTC),
+				End:        time.Date(2022, 04, 11, 15, 45, 10, 0, time.UTC),
+				Dimensions: []queryColumn{queryColumnExporterName, queryColumnInIfProvider},
+				Limit:      5,
+				Filter:     queryFilter{},
+			},
+			Expected: `
+WITH
+ (SELECT MAX(TimeReceived) - MIN(TimeReceived) FROM {table} WHERE {timefilter}) AS range,
+ rows AS (SELECT least(ExporterName, InIfProvider) AS pair1, greatest(ExporterName, InIfProvider) AS pair2 FROM {table} WHERE {timefilter} GROUP BY pair1, pair2 ORDER BY SUM(Bytes) DESC LIMIT 5)
+SELECT
+ SUM(Bytes*SamplingRate*8/range) AS bps,
+ if((least(ExporterName, InIfProvider), greatest(ExporterName, InIfProvider)) IN (SELECT pair1, pair2 FROM rows), ExporterName, 'Other') AS label1,
+ if((least(ExporterName, InIfProvider), greatest(ExporterName, InIfProvider)) IN (SELECT pair1, pair2 FROM rows), InIfProvider, 'Other') AS label2
+FROM {table}
+WHERE {timefilter}
+GROUP BY label1, label2
+ORDER BY bps DESC`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Description, func(t *testing.T) {
+			got, err := tc.Input.toSQL()
+			if err != nil {
+				t.Fatalf("toSQL() error:\n%+v", err)
+			}
+			if diff := helpers.Diff(strings.Split(got, "\n"), strings.Split(tc.Expected, "\n")); diff != "" {
+				t.Errorf("toSQL (-got, +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChordQueryWrongDimensions(t *testing.T) {
+	query := chordQuery{
+		Start:      time.Date(2022, 04, 10, 15, 45, 10, 0, time.UTC),
+		End:        time.Date(2022, 04, 11, 15, 45, 10, 0, time.UTC),
+		Dimensions: []queryColumn{queryColumnSrcAS},
+		Limit:      5,
+	}
+	if _, err := query.toSQL(); err == nil {
+		t.Error("toSQL() expected an error for a single dimension, got none")
+	}
+}
+
+func TestToChordData(t *testing.T) {
+	results := []chordQueryResult{
+		{Bps: 100, Label1: "AS100", Label2: "AS200"},
+		{Bps: 50, Label1: "AS200", Label2: "AS100"},
+		{Bps: 25, Label1: "Other", Label2: "AS100"},
+	}
+	got := toChordData(results)
+
+	labels, ok := got["labels"].([]string)
+	if !ok || len(labels) != 3 {
+		t.Fatalf("toChordData() labels = %#v, expected 3 labels", got["labels"])
+	}
+	matrix, ok := got["matrix"].([][]float64)
+	if !ok {
+		t.Fatalf("toChordData() matrix = %#v, expected [][]float64", got["matrix"])
+	}
+	// The matrix is symmetric: AS100<->AS200 aggregates both directions.
+	i, j := -1, -1
+	for idx, label := range labels {
+		switch label {
+		case "AS100":
+			i = idx
+		case "AS200":
+			j = idx
+		}
+	}
+	if matrix[i][j] != 150 || matrix[j][i] != 150 {
+		t.Errorf("toChordData() matrix[AS100][AS200] = %v, matrix[AS200][AS100] = %v, expected 150 both ways",
+			matrix[i][j], matrix[j][i])
+	}
+}
@@ -0,0 +1,157 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+// Package console exposes the HTTP endpoints backing the web console: the
+// data visualizations (sankey diagrams, ...) and their supporting queries.
+package console
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+
+	"akvorado/common/clickhousedb"
+	"akvorado/common/daemon"
+	httpCommon "akvorado/common/http"
+	"akvorado/common/reporter"
+)
+
+// defaultCacheMemorySize is the default number of entries kept by the
+// in-memory query cache when Configuration.CacheMemorySize is unset.
+const defaultCacheMemorySize = 1000
+
+// Configuration describes the configuration for the console component.
+type Configuration struct {
+	// CacheBackend selects the query result cache backend: "memory"
+	// (default) or "redis".
+	CacheBackend string
+	// CacheMemorySize is the maximum number of entries kept by the
+	// in-memory cache backend.
+	CacheMemorySize int
+	// CacheRedisURL is the Redis connection URL used when CacheBackend
+	// is "redis" (see redis.ParseURL for the accepted format).
+	CacheRedisURL string
+}
+
+// DefaultConfiguration returns the default configuration for the console component.
+func DefaultConfiguration() Configuration {
+	return Configuration{
+		CacheBackend:    "memory",
+		CacheMemorySize: defaultCacheMemorySize,
+	}
+}
+
+// Dependencies define the dependencies of the console component.
+type Dependencies struct {
+	Daemon       daemon.Component
+	HTTP         *httpCommon.Component
+	ClickHouseDB *clickhousedb.Component
+}
+
+// metrics groups the Prometheus metrics exposed by the query cache.
+type metrics struct {
+	cacheHits      *reporter.CounterVec
+	cacheMisses    *reporter.CounterVec
+	cacheEvictions reporter.Counter
+}
+
+// Component represents the console component.
+type Component struct {
+	r      *reporter.Reporter
+	d      *Dependencies
+	config Configuration
+
+	cache      queryCache
+	cacheGroup singleflight.Group
+	metrics    metrics
+
+	// streamingQueries tracks the query_id of currently streaming
+	// queries (map[string]struct{}), so DELETE /api/v0/console/query/:id
+	// can only kill queries it started.
+	streamingQueries sync.Map
+}
+
+// New creates a new console component.
+func New(r *reporter.Reporter, config Configuration, dependencies Dependencies) (*Component, error) {
+	c := Component{
+		r:      r,
+		d:      &dependencies,
+		config: config,
+	}
+	c.initMetrics()
+	cache, err := c.newCache()
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize query cache: %w", err)
+	}
+	c.cache = cache
+	c.registerHTTPHandlers()
+	return &c, nil
+}
+
+// newCache builds the query cache backend selected by c.config.CacheBackend.
+func (c *Component) newCache() (queryCache, error) {
+	switch c.config.CacheBackend {
+	case "redis":
+		options, err := redis.ParseURL(c.config.CacheRedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache-redis-url: %w", err)
+		}
+		return newRedisCache(redis.NewClient(options)), nil
+	case "", "memory":
+		size := c.config.CacheMemorySize
+		if size == 0 {
+			size = defaultCacheMemorySize
+		}
+		return newMemoryCache(size, func() {
+			c.metrics.cacheEvictions.Inc()
+		})
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", c.config.CacheBackend)
+	}
+}
+
+// initMetrics registers the Prometheus metrics for the query cache.
+func (c *Component) initMetrics() {
+	c.metrics.cacheHits = c.r.CounterVec(
+		reporter.CounterOpts{
+			Name: "cache_hits_total",
+			Help: "Number of query cache hits.",
+		},
+		[]string{"query"},
+	)
+	c.metrics.cacheMisses = c.r.CounterVec(
+		reporter.CounterOpts{
+			Name: "cache_misses_total",
+			Help: "Number of query cache misses.",
+		},
+		[]string{"query"},
+	)
+	c.metrics.cacheEvictions = c.r.Counter(
+		reporter.CounterOpts{
+			Name: "cache_evictions_total",
+			Help: "Number of query cache evictions.",
+		},
+	)
+}
+
+// registerHTTPHandlers registers the console HTTP endpoints.
+func (c *Component) registerHTTPHandlers() {
+	c.d.HTTP.GinRouter.POST("/api/v0/console/sankey", c.sankeyHandlerFunc)
+	c.d.HTTP.GinRouter.POST("/api/v0/console/chord", c.chordHandlerFunc)
+	c.d.HTTP.GinRouter.GET("/api/v0/console/sankey/stream", c.sankeyStreamHandlerFunc)
+	c.d.HTTP.GinRouter.DELETE("/api/v0/console/query/:id", c.killQueryHandlerFunc)
+}
+
+// Start starts the console component.
+func (c *Component) Start() error {
+	c.r.Info().Msg("console component starting")
+	return nil
+}
+
+// Stop stops the console component.
+func (c *Component) Stop() error {
+	c.r.Info().Msg("console component stopping")
+	return nil
+}
@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import "fmt"
+
+// queryColumn identifies a dimension that can be used to build a sankey (or
+// similar) query. It maps directly to a ClickHouse column name, with some
+// columns getting a richer textual representation (for example, AS numbers
+// are also resolved to their name).
+type queryColumn string
+
+const (
+	queryColumnSrcAS        queryColumn = "SrcAS"
+	queryColumnDstAS        queryColumn = "DstAS"
+	queryColumnExporterName queryColumn = "ExporterName"
+	queryColumnInIfProvider queryColumn = "InIfProvider"
+)
+
+// String returns the ClickHouse column name for the dimension.
+func (qc queryColumn) String() string {
+	return string(qc)
+}
+
+// toSQLSelect returns how the column should appear in a bare SELECT/GROUP BY
+// list (the "rows" CTE).
+func (qc queryColumn) toSQLSelect() string {
+	return string(qc)
+}
+
+// toSQLLabel returns the expression producing the human-readable label for a
+// value of this dimension, resolving AS numbers to their name through the
+// asns dictionary.
+func (qc queryColumn) toSQLLabel() string {
+	col := string(qc)
+	switch qc {
+	case queryColumnSrcAS, queryColumnDstAS:
+		return fmt.Sprintf("concat(toString(%s), ': ', dictGetOrDefault('asns', 'name', %s, '???'))", col, col)
+	default:
+		return col
+	}
+}
+
+// toSQLDimension returns the expression bucketing a row onto its matched
+// value when it belongs to the top kept values (the "rows" CTE), or "Other"
+// otherwise.
+func (qc queryColumn) toSQLDimension() string {
+	col := string(qc)
+	return fmt.Sprintf("if(%s IN (SELECT %s FROM rows), %s, 'Other')", col, col, qc.toSQLLabel())
+}
+
+// queryFilter is a set of SQL boolean expressions, ANDed together, used to
+// restrict a query to a subset of the flows table.
+type queryFilter []string
@@ -0,0 +1,256 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"akvorado/common/helpers"
+	httpCommon "akvorado/common/http"
+)
+
+// sankeyQuery describes a sankey query: a set of ordered dimensions, a time
+// range and a rule (Limit or Aggregation) selecting which combinations to
+// keep before lumping the remainder into "Other" buckets.
+type sankeyQuery struct {
+	Start      time.Time     `json:"start" binding:"required"`
+	End        time.Time     `json:"end" binding:"required,gtfield=Start"`
+	Dimensions []queryColumn `json:"dimensions" binding:"required,min=1"`
+	// Limit is a shorthand for Aggregation = {Mode: "topN", N: Limit}.
+	// It is mutually exclusive with Aggregation.
+	Limit       int          `json:"limit" binding:"required_without=Aggregation,max=50"`
+	Aggregation *aggregation `json:"aggregation,omitempty"`
+	Filter      queryFilter  `json:"filter"`
+}
+
+// effectiveAggregation resolves the Other-bucketing aggregation to use for
+// the query, defaulting to {Mode: "topN", N: Limit} when Aggregation is not
+// set. It is an error to set both Limit and Aggregation.
+func (query sankeyQuery) effectiveAggregation() (aggregation, error) {
+	agg := aggregation{Mode: aggregationModeTopN, N: query.Limit}
+	if query.Aggregation != nil {
+		if query.Limit != 0 {
+			return aggregation{}, fmt.Errorf("limit and aggregation are mutually exclusive")
+		}
+		agg = *query.Aggregation
+	}
+	if err := agg.validate(); err != nil {
+		return aggregation{}, err
+	}
+	return agg, nil
+}
+
+// toSQL converts a sankey query into the ClickHouse SQL query fetching the
+// bps contributed by each combination of dimension values, with values
+// outside of the kept set (see effectiveAggregation) lumped into "Other".
+func (query sankeyQuery) toSQL() (string, error) {
+	agg, err := query.effectiveAggregation()
+	if err != nil {
+		return "", err
+	}
+
+	where := "{timefilter}"
+	if len(query.Filter) > 0 {
+		where = fmt.Sprintf("%s AND (%s)", where, strings.Join(query.Filter, " AND "))
+	}
+
+	selectColumns := make([]string, len(query.Dimensions))
+	dimensionExprs := make([]string, len(query.Dimensions))
+	for i, dimension := range query.Dimensions {
+		selectColumns[i] = dimension.toSQLSelect()
+		dimensionExprs[i] = dimension.toSQLDimension()
+	}
+	dimensionsBlock := fmt.Sprintf(" [%s] AS dimensions", strings.Join(dimensionExprs, ",\n  "))
+	rowsSubquery := agg.rowsSubquery(strings.Join(selectColumns, ", "), where, len(query.Dimensions))
+
+	sqlQuery := fmt.Sprintf(`
+WITH
+ (SELECT MAX(TimeReceived) - MIN(TimeReceived) FROM {table} WHERE %s) AS range,
+ %s
+SELECT
+ SUM(Bytes*SamplingRate*8/range) AS bps,
+%s
+FROM {table}
+WHERE %s
+GROUP BY dimensions
+ORDER BY bps DESC`,
+		where,
+		rowsSubquery,
+		dimensionsBlock,
+		where)
+	return sqlQuery, nil
+}
+
+// sankeyQueryResult is a single row returned by ClickHouse for a sankey query.
+type sankeyQueryResult struct {
+	Bps        float64  `ch:"bps"`
+	Dimensions []string `ch:"dimensions"`
+}
+
+// toSankeyData turns the raw ClickHouse rows into the rows/bps/nodes/links
+// payload expected by the frontend sankey diagram. Nodes are listed in the
+// order they are first seen (reading each row left to right), links are
+// deduplicated on their (source, target) pair and sorted by decreasing bps.
+func (query sankeyQuery) toSankeyData(results []sankeyQueryResult) gin.H {
+	rows := make([][]string, len(results))
+	bps := make([]int, len(results))
+	nodes := []string{}
+	seenNodes := map[string]bool{}
+
+	type linkKey struct{ source, target string }
+	linkOrder := []linkKey{}
+	linkBps := map[linkKey]int{}
+
+	for i, result := range results {
+		rows[i] = result.Dimensions
+		bps[i] = int(result.Bps)
+
+		names := make([]string, len(result.Dimensions))
+		for j, value := range result.Dimensions {
+			name := value
+			if value == "Other" {
+				name = fmt.Sprintf("Other %s", query.Dimensions[j])
+			}
+			names[j] = name
+			if !seenNodes[name] {
+				seenNodes[name] = true
+				nodes = append(nodes, name)
+			}
+		}
+		for j := 0; j < len(names)-1; j++ {
+			key := linkKey{names[j], names[j+1]}
+			if _, ok := linkBps[key]; !ok {
+				linkOrder = append(linkOrder, key)
+			}
+			linkBps[key] += int(result.Bps)
+		}
+	}
+
+	links := make([]gin.H, len(linkOrder))
+	for i, key := range linkOrder {
+		links[i] = gin.H{"source": key.source, "target": key.target, "bps": linkBps[key]}
+	}
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i]["bps"].(int) > links[j]["bps"].(int)
+	})
+
+	return gin.H{
+		"rows":     rows,
+		"bps":      bps,
+		"nodes":    nodes,
+		"links":    links,
+		"coverage": coverage(results),
+	}
+}
+
+// sankeyHandlerFunc handles a sankey query: it parses the query, runs it
+// against ClickHouse and returns the result, negotiating the representation
+// (JSON, CSV or TSV) requested by the client.
+func (c *Component) sankeyHandlerFunc(ctx *gin.Context) {
+	var input sankeyQuery
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": helpers.Capitalize(err.Error())})
+		return
+	}
+
+	sqlQuery, err := input.toSQL()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": helpers.Capitalize(err.Error())})
+		return
+	}
+	sqlQuery = c.finalizeQuery(sqlQuery, input.Start, input.End)
+
+	results, err := c.runSankeyQuery(ctx.Request.Context(), input, sqlQuery)
+	if err != nil {
+		c.r.Err(err).Msg("unable to query sankey data")
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": "unable to query ClickHouse"})
+		return
+	}
+
+	dimensionNames := make([]string, len(input.Dimensions))
+	for i, dimension := range input.Dimensions {
+		dimensionNames[i] = dimension.String()
+	}
+	rowsBps := make([]float64, len(results))
+	rows := make([][]string, len(results))
+	for i, result := range results {
+		rows[i] = result.Dimensions
+		rowsBps[i] = result.Bps
+	}
+
+	httpCommon.NegotiateTabular(ctx, dimensionNames, rows, rowsBps, func() gin.H {
+		return input.toSankeyData(results)
+	})
+}
+
+// finalizeQuery substitutes the {table} and {timefilter} placeholders left by
+// toSQL() with the actual flows table and time range.
+func (c *Component) finalizeQuery(sqlQuery string, start, end time.Time) string {
+	timefilter := fmt.Sprintf("TimeReceived BETWEEN toDateTime(%d) AND toDateTime(%d)", start.Unix(), end.Unix())
+	sqlQuery = strings.ReplaceAll(sqlQuery, "{timefilter}", timefilter)
+	sqlQuery = strings.ReplaceAll(sqlQuery, "{table}", "flows")
+	return sqlQuery
+}
+
+// cacheKeyParts returns the canonicalized parameters used to key the query
+// cache. Limit and Aggregation are collapsed through effectiveAggregation so
+// that, say, {Limit: 5} and {Aggregation: {Mode: "topN", N: 5}} hit the same
+// cache entry, and the raw filter clauses are sorted so that semantically
+// identical filters expressed in a different order do too.
+func (query sankeyQuery) cacheKeyParts() (any, error) {
+	agg, err := query.effectiveAggregation()
+	if err != nil {
+		return nil, err
+	}
+	filter := append([]string{}, query.Filter...)
+	sort.Strings(filter)
+	return struct {
+		Start       time.Time
+		End         time.Time
+		Dimensions  []queryColumn
+		Aggregation aggregation
+		Filter      []string
+	}{query.Start, query.End, query.Dimensions, agg, filter}, nil
+}
+
+// runSankeyQuery executes sqlQuery against ClickHouse, going through the
+// query cache so that identical sankey queries issued concurrently (for
+// example by several browsers viewing the same dashboard) share a single
+// ClickHouse round-trip.
+func (c *Component) runSankeyQuery(ctx context.Context, input sankeyQuery, sqlQuery string) ([]sankeyQueryResult, error) {
+	keyParts, err := input.cacheKeyParts()
+	if err != nil {
+		return nil, err
+	}
+	key, err := cacheKey("sankey", keyParts)
+	if err != nil {
+		return nil, err
+	}
+	ttl := cacheTTL(input.End, time.Now())
+
+	encoded, err := c.cachedQuery(ctx, "sankey", key, ttl, func() ([]byte, error) {
+		var results []sankeyQueryResult
+		if err := c.d.ClickHouseDB.Conn.Select(ctx, &results, sqlQuery); err != nil {
+			return nil, err
+		}
+		return json.Marshal(results)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []sankeyQueryResult
+	if err := json.Unmarshal(encoded, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
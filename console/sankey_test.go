@@ -124,6 +124,8 @@ func TestSankeyHandler(t *testing.T) {
 		{159, []string{"Other", "provider1", "router1"}},
 	}
 	expected := gin.H{
+		// Fraction of total bps represented by rows with no "Other" dimension.
+		"coverage": 20473.0 / 83759.0,
 		// Raw data
 		"rows": [][]string{
 			{"AS100", "Other", "router1"},
@@ -252,4 +254,91 @@ func TestSankeyHandler(t *testing.T) {
 	if diff := helpers.Diff(got, expected); diff != "" {
 		t.Fatalf("POST /api/v0/console/sankey (-got, +want):\n%s", diff)
 	}
+}
+
+func TestSankeyHandlerTabular(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	h := http.NewMock(t, r)
+	c, err := New(r, Configuration{}, Dependencies{
+		Daemon:       daemon.NewMock(t),
+		HTTP:         h,
+		ClickHouseDB: ch,
+	})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	helpers.StartStop(t, c)
+
+	expectedSQL := []struct {
+		Bps        float64  `ch:"bps"`
+		Dimensions []string `ch:"dimensions"`
+	}{
+		{9677, []string{"AS100", "router1"}},
+		{9472, []string{"AS300", "router2"}},
+	}
+
+	input := sankeyQuery{
+		Start:      time.Date(2022, 04, 10, 15, 45, 10, 0, time.UTC),
+		End:        time.Date(2022, 04, 11, 15, 45, 10, 0, time.UTC),
+		Dimensions: []queryColumn{queryColumnSrcAS, queryColumnExporterName},
+		Limit:      10,
+		Filter:     queryFilter{},
+	}
+
+	cases := []struct {
+		Accept      string
+		ContentType string
+		Expected    string
+	}{
+		{
+			Accept:      "text/csv",
+			ContentType: "text/csv; charset=utf-8",
+			Expected:    "SrcAS,ExporterName,bps\nAS100,router1,9677\nAS300,router2,9472\n",
+		}, {
+			Accept:      "text/tab-separated-values",
+			ContentType: "text/tab-separated-values; charset=utf-8",
+			Expected:    "SrcAS\tExporterName\tbps\nAS100\trouter1\t9677\nAS300\trouter2\t9472\n",
+		},
+	}
+	// Both subtests send the same query: only the first one reaches
+	// ClickHouse, the second one is served from the query cache.
+	mockConn.EXPECT().
+		Select(gomock.Any(), gomock.Any(), gomock.Any()).
+		SetArg(1, expectedSQL).
+		Return(nil)
+	for _, tc := range cases {
+		t.Run(tc.Accept, func(t *testing.T) {
+			payload := new(bytes.Buffer)
+			if err := json.NewEncoder(payload).Encode(input); err != nil {
+				t.Fatalf("Encode() error:\n%+v", err)
+			}
+			req, err := netHTTP.NewRequest("POST",
+				fmt.Sprintf("http://%s/api/v0/console/sankey", h.Address), payload)
+			if err != nil {
+				t.Fatalf("NewRequest() error:\n%+v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept", tc.Accept)
+			resp, err := netHTTP.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("POST /api/v0/console/sankey:\n%+v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Errorf("POST /api/v0/console/sankey: got status code %d, not 200", resp.StatusCode)
+			}
+			if gotContentType := resp.Header.Get("Content-Type"); gotContentType != tc.ContentType {
+				t.Errorf("POST /api/v0/console/sankey Content-Type (-got, +want):\n-%s\n+%s",
+					gotContentType, tc.ContentType)
+			}
+			body := new(bytes.Buffer)
+			if _, err := body.ReadFrom(resp.Body); err != nil {
+				t.Fatalf("ReadFrom() error:\n%+v", err)
+			}
+			if diff := helpers.Diff(strings.Split(body.String(), "\n"), strings.Split(tc.Expected, "\n")); diff != "" {
+				t.Errorf("POST /api/v0/console/sankey body (-got, +want):\n%s", diff)
+			}
+		})
+	}
 }
\ No newline at end of file
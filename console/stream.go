@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"akvorado/common/helpers"
+)
+
+// progressPollInterval is how often the streaming handlers poll
+// system.processes to report query progress to the client.
+const progressPollInterval = 500 * time.Millisecond
+
+// queryUntrackGrace is how long a query_id stays valid for
+// killQueryHandlerFunc after its streaming request returns. The browser
+// navigating away is exactly what cancels ctx.Request.Context(), so
+// untracking the query_id right then (instead of after this grace period)
+// would make the companion DELETE racing against that same disconnection
+// arrive too late to ever issue a KILL QUERY.
+const queryUntrackGrace = 30 * time.Second
+
+// sankeyQueryOutcome carries the result of a sankey query run in the
+// background while sankeyStreamHandlerFunc reports its progress.
+type sankeyQueryOutcome struct {
+	results []sankeyQueryResult
+	err     error
+}
+
+// sankeyStreamHandlerFunc is the SSE variant of sankeyHandlerFunc: it keeps
+// the connection open, emitting "progress" events while the ClickHouse query
+// is still running and a final "result" event once it completes. This
+// avoids the browser hanging with no feedback on long-running queries, and
+// lets the frontend cancel the query (through killQueryHandlerFunc) if the
+// user navigates away.
+func (c *Component) sankeyStreamHandlerFunc(ctx *gin.Context) {
+	var input sankeyQuery
+	if err := json.Unmarshal([]byte(ctx.Query("query")), &input); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": helpers.Capitalize(err.Error())})
+		return
+	}
+	sqlQuery, err := input.toSQL()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": helpers.Capitalize(err.Error())})
+		return
+	}
+	sqlQuery = c.finalizeQuery(sqlQuery, input.Start, input.End)
+
+	queryID := uuid.NewString()
+	c.trackQuery(queryID)
+	defer time.AfterFunc(queryUntrackGrace, func() { c.untrackQuery(queryID) })
+
+	done := make(chan sankeyQueryOutcome, 1)
+	go func() {
+		results, err := c.runIdentifiedQuery(ctx.Request.Context(), queryID, sqlQuery)
+		done <- sankeyQueryOutcome{results, err}
+	}()
+
+	ticker := time.NewTicker(progressPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case outcome := <-done:
+			if outcome.err != nil {
+				ctx.SSEvent("error", gin.H{"message": outcome.err.Error()})
+			} else {
+				ctx.SSEvent("result", input.toSankeyData(outcome.results))
+			}
+			ctx.Writer.Flush()
+			return
+		case <-ticker.C:
+			progress, err := c.queryProgress(ctx.Request.Context(), queryID)
+			if err != nil {
+				continue
+			}
+			ctx.SSEvent("progress", progress)
+			ctx.Writer.Flush()
+		}
+	}
+}
+
+// runIdentifiedQuery runs sqlQuery against ClickHouse, tagging it with
+// queryID so its progress can be polled through system.processes and so it
+// can be cancelled through killQueryHandlerFunc.
+func (c *Component) runIdentifiedQuery(ctx context.Context, queryID, sqlQuery string) ([]sankeyQueryResult, error) {
+	ctx = clickhouse.Context(ctx, clickhouse.WithQueryID(queryID))
+	var results []sankeyQueryResult
+	if err := c.d.ClickHouseDB.Conn.Select(ctx, &results, sqlQuery); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// queryProgress reports how many rows system.processes says have been read
+// so far for queryID, out of the approximate total.
+func (c *Component) queryProgress(ctx context.Context, queryID string) (gin.H, error) {
+	var rows []struct {
+		ReadRows        uint64 `ch:"read_rows"`
+		TotalRowsApprox uint64 `ch:"total_rows_approx"`
+	}
+	if err := c.d.ClickHouseDB.Conn.Select(ctx, &rows,
+		"SELECT read_rows, total_rows_approx FROM system.processes WHERE query_id = ?", queryID); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return gin.H{"readRows": 0, "totalRows": 0}, nil
+	}
+	return gin.H{"readRows": rows[0].ReadRows, "totalRows": rows[0].TotalRowsApprox}, nil
+}
+
+// trackQuery registers queryID as a currently-streaming query, so that a
+// companion DELETE request can be authorized to kill it.
+func (c *Component) trackQuery(queryID string) {
+	c.streamingQueries.Store(queryID, struct{}{})
+}
+
+// untrackQuery removes queryID, after which killQueryHandlerFunc will
+// reject a DELETE for it. Called after queryUntrackGrace has elapsed since
+// the streaming request returned, not immediately, so a DELETE racing
+// against the browser navigating away still has a chance to land.
+func (c *Component) untrackQuery(queryID string) {
+	c.streamingQueries.Delete(queryID)
+}
+
+// killQueryHandlerFunc handles DELETE /api/v0/console/query/:id: it issues
+// a KILL QUERY for the given query_id, letting the frontend cancel a
+// streaming query the user navigated away from.
+func (c *Component) killQueryHandlerFunc(ctx *gin.Context) {
+	queryID := ctx.Param("id")
+	if _, ok := c.streamingQueries.Load(queryID); !ok {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": "unknown or already completed query"})
+		return
+	}
+	if err := c.d.ClickHouseDB.Conn.Exec(ctx.Request.Context(), "KILL QUERY WHERE query_id = ?", queryID); err != nil {
+		c.r.Err(err).Str("query-id", queryID).Msg("unable to kill query")
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("unable to kill query %s", queryID)})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,38 @@
+// SPDX-FileCopyrightText: 2022 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package console
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestKillQueryHandlerFuncUnknownQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c := &Component{}
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Params = gin.Params{{Key: "id", Value: "some-untracked-id"}}
+
+	c.killQueryHandlerFunc(ctx)
+
+	if w.Code != 404 {
+		t.Errorf("killQueryHandlerFunc() on an untracked query returned status %d, expected 404", w.Code)
+	}
+}
+
+func TestTrackQuery(t *testing.T) {
+	c := &Component{}
+	c.trackQuery("abc")
+	if _, ok := c.streamingQueries.Load("abc"); !ok {
+		t.Error("trackQuery() did not register the query")
+	}
+	c.untrackQuery("abc")
+	if _, ok := c.streamingQueries.Load("abc"); ok {
+		t.Error("untrackQuery() did not remove the query")
+	}
+}